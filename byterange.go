@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// segmentRef is what a /segment/:id route resolves to: the upstream URL of
+// the parent file plus the optional EXT-X-BYTERANGE slice within it. Limit<=0
+// means "no byte range", i.e. the whole file is the segment.
+type segmentRef struct {
+	URL    string `json:"url"`
+	Offset int64  `json:"offset"`
+	Limit  int64  `json:"limit"`
+}
+
+// parentCacheID is the cache filename for the physical file backing ref.URL,
+// shared by every segmentRef that points at the same URL regardless of byte
+// range, so a byte-range playlist downloads its parent file once rather than
+// once per segment.
+func parentCacheID(url string) string {
+	return hashID(url)
+}
+
+// segmentRouteID is the /segment/:id route id for a given URL+range. For
+// whole-file segments (limit<=0) it's identical to parentCacheID, so the
+// pre-byte-range behavior (id doubles as the cache filename) is unchanged.
+func segmentRouteID(url string, offset, limit int64) string {
+	if limit <= 0 {
+		return parentCacheID(url)
+	}
+	return hashID(fmt.Sprintf("%s#%d-%d", url, offset, offset+limit-1))
+}
+
+// parentStillReferenced reports whether any currently-registered segmentMap
+// entry still points at the parent cache file parentID. Used before deleting
+// a parent file early (live.go's TTL-based gcEvicted) so a byte range that's
+// still reachable from another route isn't yanked out from under it; the
+// regular LRU sweep in cacheindex.go doesn't need this check since it leaves
+// segmentMap routes alone and lets them self-heal by re-downloading.
+func parentStillReferenced(parentID string) bool {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	for _, ref := range segmentMap {
+		if parentCacheID(ref.URL) == parentID {
+			return true
+		}
+	}
+	return false
+}
+
+// boundedReadSeeker exposes a byte range of an underlying file as a
+// self-contained io.ReadSeeker whose positions start at 0, so
+// http.ServeContent (and any inbound Range header) operate relative to the
+// segment itself rather than the parent file it's sliced from.
+type boundedReadSeeker struct {
+	f    *os.File
+	base int64
+	size int64
+	pos  int64
+	mu   sync.Mutex
+}
+
+func newBoundedReadSeeker(f *os.File, base, size int64) *boundedReadSeeker {
+	return &boundedReadSeeker{f: f, base: base, size: size}
+}
+
+func (b *boundedReadSeeker) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pos >= b.size {
+		return 0, io.EOF
+	}
+	if remaining := b.size - b.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.f.ReadAt(p, b.base+b.pos)
+	b.pos += int64(n)
+	return n, err
+}
+
+func (b *boundedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = b.pos + offset
+	case io.SeekEnd:
+		newPos = b.size + offset
+	default:
+		return 0, fmt.Errorf("boundedReadSeeker: invalid whence %d", whence)
+	}
+	if newPos < 0 {
+		return 0, fmt.Errorf("boundedReadSeeker: negative position")
+	}
+	b.pos = newPos
+	return newPos, nil
+}
+
+// serveSegment serves ref's bytes from its cached parent file, honoring any
+// inbound Range header from the player (seek/scrub) via http.ServeContent.
+// When ref.Limit is set, the served content is just that EXT-X-BYTERANGE
+// slice of the parent file, re-based so Range requests from the player are
+// relative to the segment rather than the parent.
+func serveSegment(c *gin.Context, ref segmentRef) {
+	filename := filepath.Join(cacheDir, parentCacheID(ref.URL))
+
+	f, err := os.Open(filename)
+	if err != nil {
+		c.String(500, "failed to open cached segment: %s", err)
+		return
+	}
+	defer f.Close()
+
+	var modTime time.Time
+	if info, err := f.Stat(); err == nil {
+		modTime = info.ModTime()
+	}
+
+	if ref.Limit <= 0 {
+		http.ServeContent(c.Writer, c.Request, filepath.Base(filename), modTime, f)
+		return
+	}
+
+	http.ServeContent(c.Writer, c.Request, filepath.Base(filename), modTime, newBoundedReadSeeker(f, ref.Offset, ref.Limit))
+}
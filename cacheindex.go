@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// segmentMeta is the LRU bookkeeping kept alongside a segmentMap entry so a
+// restart doesn't orphan cache files and so eviction has something to sort
+// on. ContentType/ETag are recorded from the upstream response; segments are
+// immutable per the HLS spec, so only live.go's refresh loop revalidates.
+type segmentMeta struct {
+	RemoteURL   string    `json:"remote_url"`
+	ByteSize    int64     `json:"byte_size"`
+	LastAccess  time.Time `json:"last_access"`
+	ContentType string    `json:"content_type,omitempty"`
+	ETag        string    `json:"etag,omitempty"`
+}
+
+// onDiskIndex is the on-disk shape of cacheDir/index.json: enough to
+// reconstruct playlistMap/segmentMap (and the LRU metadata) after a restart
+// without re-registering every stream from scratch. Routes and Segments are
+// keyed differently: Routes is segmentMap itself (route id -> URL/byte
+// range), while Segments is per physical cache file (parent id -> LRU
+// metadata), since several routes can share one file.
+type onDiskIndex struct {
+	Playlists map[string]playlistEntry `json:"playlists"`
+	Routes    map[string]segmentRef    `json:"routes"`
+	Segments  map[string]*segmentMeta  `json:"segments"`
+}
+
+var (
+	segmentMetaLock sync.Mutex
+	segmentMetaMap  = make(map[string]*segmentMeta)
+)
+
+// cacheMaxBytes/cacheMaxAge bound the on-disk cache; 0 means unbounded.
+// Configured via CACHE_MAX_BYTES (integer bytes) and CACHE_MAX_AGE (Go
+// duration, e.g. "2h").
+var (
+	cacheMaxBytes = parseCacheMaxBytes()
+	cacheMaxAge   = parseCacheMaxAge()
+)
+
+const cacheSweepInterval = 30 * time.Second
+
+func parseCacheMaxBytes() int64 {
+	v := os.Getenv("CACHE_MAX_BYTES")
+	if v == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		fmt.Printf("cache index: invalid CACHE_MAX_BYTES %q: %s\n", v, err)
+		return 0
+	}
+	return n
+}
+
+func parseCacheMaxAge() time.Duration {
+	v := os.Getenv("CACHE_MAX_AGE")
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		fmt.Printf("cache index: invalid CACHE_MAX_AGE %q: %s\n", v, err)
+		return 0
+	}
+	return d
+}
+
+func init() {
+	go runCacheSweeper()
+}
+
+func indexPath() string {
+	return filepath.Join(cacheDir, "index.json")
+}
+
+// loadCacheIndex restores playlistMap/segmentMap/segmentMetaMap from
+// cacheDir/index.json, if present, so already-registered streams and cached
+// segments remain resolvable across a restart. Must be called after
+// cacheDir has been created.
+func loadCacheIndex() {
+	data, err := os.ReadFile(indexPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("cache index: reading index: %s\n", err)
+		}
+		return
+	}
+
+	var idx onDiskIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		fmt.Printf("cache index: decoding index: %s\n", err)
+		return
+	}
+
+	mapLock.Lock()
+	for id, entry := range idx.Playlists {
+		playlistMap[id] = entry
+	}
+	for id, ref := range idx.Routes {
+		segmentMap[id] = ref
+	}
+	mapLock.Unlock()
+
+	segmentMetaLock.Lock()
+	for id, meta := range idx.Segments {
+		segmentMetaMap[id] = meta
+	}
+	segmentMetaLock.Unlock()
+
+	fmt.Printf("cache index: loaded %d playlists, %d segment routes\n", len(idx.Playlists), len(idx.Routes))
+}
+
+// persistCacheIndex writes the current playlistMap/segmentMetaMap to
+// cacheDir/index.json via a temp file + rename, so a crash mid-write can't
+// corrupt the index.
+func persistCacheIndex() {
+	mapLock.RLock()
+	playlists := make(map[string]playlistEntry, len(playlistMap))
+	for id, entry := range playlistMap {
+		playlists[id] = entry
+	}
+	routes := make(map[string]segmentRef, len(segmentMap))
+	for id, ref := range segmentMap {
+		routes[id] = ref
+	}
+	mapLock.RUnlock()
+
+	segmentMetaLock.Lock()
+	segments := make(map[string]*segmentMeta, len(segmentMetaMap))
+	for id, meta := range segmentMetaMap {
+		m := *meta
+		segments[id] = &m
+	}
+	segmentMetaLock.Unlock()
+
+	data, err := json.Marshal(onDiskIndex{Playlists: playlists, Routes: routes, Segments: segments})
+	if err != nil {
+		fmt.Printf("cache index: encoding index: %s\n", err)
+		return
+	}
+
+	tmp := indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		fmt.Printf("cache index: writing index: %s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, indexPath()); err != nil {
+		fmt.Printf("cache index: renaming index: %s\n", err)
+	}
+}
+
+// registerSegmentMeta ensures a segmentMetaMap entry exists for id, without
+// clobbering ByteSize/LastAccess if it was already known (e.g. restored from
+// disk or already downloaded).
+func registerSegmentMeta(id, remoteURL string) {
+	segmentMetaLock.Lock()
+	if _, ok := segmentMetaMap[id]; !ok {
+		segmentMetaMap[id] = &segmentMeta{RemoteURL: remoteURL}
+	}
+	segmentMetaLock.Unlock()
+}
+
+// touchSegmentAccess updates a segment's LastAccess, for LRU purposes. The
+// updated time is not written to disk here, since this runs on the hot
+// /segment/:id path; it reaches disk with the next persistCacheIndex call
+// (a download, a playlist registration or refresh, or a sweep that evicts).
+func touchSegmentAccess(id string) {
+	segmentMetaLock.Lock()
+	if m, ok := segmentMetaMap[id]; ok {
+		m.LastAccess = time.Now()
+	}
+	segmentMetaLock.Unlock()
+}
+
+// recordSegmentDownloaded updates a segment's size, access time and upstream
+// contentType/etag after a successful download and persists the index
+// immediately, so the file is resolvable even if the process is killed right
+// after. contentType/etag are left untouched if empty, since retried or
+// re-served downloads shouldn't erase previously recorded values.
+func recordSegmentDownloaded(id, filename, contentType, etag string) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+
+	segmentMetaLock.Lock()
+	m, ok := segmentMetaMap[id]
+	if !ok {
+		m = &segmentMeta{}
+		segmentMetaMap[id] = m
+	}
+	m.ByteSize = info.Size()
+	m.LastAccess = time.Now()
+	if contentType != "" {
+		m.ContentType = contentType
+	}
+	if etag != "" {
+		m.ETag = etag
+	}
+	segmentMetaLock.Unlock()
+
+	persistCacheIndex()
+}
+
+func runCacheSweeper() {
+	for {
+		time.Sleep(cacheSweepInterval)
+		sweepCache()
+	}
+}
+
+// sweepCache evicts segments older than cacheMaxAge, then evicts the
+// least-recently-used remaining segments until the total cache size is back
+// under cacheMaxBytes.
+func sweepCache() {
+	type entry struct {
+		id   string
+		meta segmentMeta
+	}
+
+	segmentMetaLock.Lock()
+	all := make([]entry, 0, len(segmentMetaMap))
+	var total int64
+	for id, m := range segmentMetaMap {
+		all = append(all, entry{id: id, meta: *m})
+		total += m.ByteSize
+	}
+	segmentMetaLock.Unlock()
+
+	now := time.Now()
+	evict := make(map[string]bool)
+
+	if cacheMaxAge > 0 {
+		for _, e := range all {
+			if !e.meta.LastAccess.IsZero() && now.Sub(e.meta.LastAccess) > cacheMaxAge {
+				evict[e.id] = true
+				total -= e.meta.ByteSize
+			}
+		}
+	}
+
+	if cacheMaxBytes > 0 && total > cacheMaxBytes {
+		sort.Slice(all, func(i, j int) bool {
+			return all[i].meta.LastAccess.Before(all[j].meta.LastAccess)
+		})
+		for _, e := range all {
+			if total <= cacheMaxBytes {
+				break
+			}
+			if evict[e.id] {
+				continue
+			}
+			evict[e.id] = true
+			total -= e.meta.ByteSize
+		}
+	}
+
+	if len(evict) == 0 {
+		return
+	}
+
+	for id := range evict {
+		evictSegment(id)
+	}
+	persistCacheIndex()
+}
+
+// evictSegment deletes the cached bytes and LRU metadata for the physical
+// file keyed by parentID. It deliberately leaves segmentMap routes alone:
+// several routes (different EXT-X-BYTERANGE slices, or the same whole-file
+// segment referenced from more than one playlist) may still point at
+// parentID, and ensureSegmentDownloaded will transparently re-fetch the file
+// the next time any of them is requested.
+func evictSegment(parentID string) {
+	segmentMetaLock.Lock()
+	delete(segmentMetaMap, parentID)
+	segmentMetaLock.Unlock()
+
+	if err := os.Remove(filepath.Join(cacheDir, parentID)); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("cache index: evicting segment %s: %s\n", parentID, err)
+	}
+}
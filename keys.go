@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/grafov/m3u8"
+)
+
+// decryptSegments controls whether AES-128 encrypted segments are decrypted
+// server-side and republished as cleartext (dropping EXT-X-KEY), for players
+// that can't reach the upstream key server.
+var decryptSegments = os.Getenv("DECRYPT_SEGMENTS") == "true"
+
+var (
+	keyMap  = make(map[string]string) // id -> remote key URL
+	initMap = make(map[string]string) // id -> remote EXT-X-MAP init segment URL
+)
+
+// rewriteSegmentKeyAndMap registers seg's EXT-X-KEY and EXT-X-MAP (if any)
+// under local /key/:id and /init/:id routes and points newSeg at them. id is
+// newSeg's own segment id, used to key decryptMap when decryptSegments is
+// enabled. baseURL resolves relative key/map URIs.
+//
+// Decryption is only attempted for whole-file segments (seg.Limit <= 0):
+// decryptSegmentFile keys off the cached parent file, which only equals id
+// in that case. Byte-range segments keep their EXT-X-KEY instead.
+func rewriteSegmentKeyAndMap(seg, newSeg *m3u8.MediaSegment, baseURL, id string) {
+	if seg.Key != nil && seg.Key.URI != "" {
+		keyURL := resolveRelative(baseURL, seg.Key.URI)
+		keyID := hashID(keyURL)
+
+		mapLock.Lock()
+		keyMap[keyID] = keyURL
+		mapLock.Unlock()
+
+		if decryptSegments && seg.Key.Method == "AES-128" && seg.Limit <= 0 {
+			registerDecrypt(id, keyURL, seg.Key.IV, seg.SeqId)
+			newSeg.Key = nil
+		} else {
+			k := *seg.Key
+			k.URI = "/key/" + keyID
+			newSeg.Key = &k
+		}
+	}
+
+	if seg.Map != nil && seg.Map.URI != "" {
+		initURL := resolveRelative(baseURL, seg.Map.URI)
+		initID := hashID(initURL)
+
+		mapLock.Lock()
+		initMap[initID] = initURL
+		mapLock.Unlock()
+
+		m := *seg.Map
+		m.URI = "/init/" + initID
+		newSeg.Map = &m
+	}
+}
+
+// decryptInfo carries what's needed to AES-128-CBC decrypt a segment once
+// it's been downloaded.
+type decryptInfo struct {
+	keyURL string
+	iv     [aes.BlockSize]byte
+}
+
+var (
+	decryptLock sync.Mutex
+	decryptMap  = make(map[string]decryptInfo) // segment id -> decrypt info
+)
+
+// registerDecrypt records that the segment with the given id needs AES-128
+// decryption once downloaded. ivHex is the EXT-X-KEY IV attribute verbatim
+// (may be empty); per the HLS spec, when it's omitted the media sequence
+// number is used as a big-endian 128-bit IV.
+func registerDecrypt(id, keyURL, ivHex string, sequence uint64) {
+	var iv [aes.BlockSize]byte
+	ivHex = strings.TrimPrefix(strings.ToLower(ivHex), "0x")
+	if b, err := hex.DecodeString(ivHex); err == nil && len(b) == aes.BlockSize {
+		copy(iv[:], b)
+	} else {
+		for i := 0; i < 8; i++ {
+			iv[aes.BlockSize-1-i] = byte(sequence >> (8 * i))
+		}
+	}
+
+	decryptLock.Lock()
+	decryptMap[id] = decryptInfo{keyURL: keyURL, iv: iv}
+	decryptLock.Unlock()
+}
+
+// decryptSegmentFile decrypts an AES-128-CBC encrypted segment file in place,
+// if id was registered via registerDecrypt. It's a no-op otherwise.
+func decryptSegmentFile(ctx context.Context, id, filename string) error {
+	decryptLock.Lock()
+	info, ok := decryptMap[id]
+	decryptLock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	keyID := "key_" + hashID(info.keyURL)
+	if err := ensureSegmentDownloaded(ctx, keyID, info.keyURL); err != nil {
+		return fmt.Errorf("fetching key for decryption: %w", err)
+	}
+	key, err := os.ReadFile(filepath.Join(cacheDir, keyID))
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return fmt.Errorf("segment %s is not a multiple of the AES block size", id)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, info.iv[:]).CryptBlocks(out, data)
+	out = pkcs7Unpad(out)
+
+	return os.WriteFile(filename, out, 0644)
+}
+
+// pkcs7Unpad strips PKCS#7 padding, the scheme HLS AES-128 segments use.
+func pkcs7Unpad(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	pad := int(data[len(data)-1])
+	if pad <= 0 || pad > len(data) {
+		return data
+	}
+	return data[:len(data)-pad]
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grafov/m3u8"
+)
+
+// liveWindowSize bounds how many segments a live playlist keeps in its
+// sliding window before the oldest one slides out.
+const liveWindowSize = 10
+
+// liveSegmentTTL is how long an evicted live segment's cache file and
+// segmentMap entry are kept around before being garbage-collected, so a
+// player that's a little behind the live edge doesn't 404.
+const liveSegmentTTL = 2 * time.Minute
+
+// livePlaylist mirrors a live/sliding-window upstream media playlist. A
+// background goroutine re-fetches the upstream at roughly TargetDuration
+// cadence and requests are served from the in-memory snapshot instead of
+// hitting the upstream synchronously.
+type livePlaylist struct {
+	mediaURL string
+
+	mu           sync.Mutex
+	pl           *m3u8.MediaPlaylist
+	order        []string             // segment ids currently in the window, oldest first
+	known        map[string]bool      // segment id -> currently in the window
+	evicted      map[string]time.Time // segment id -> time it slid out of the window
+	encoded      string
+	etag         string // upstream ETag, for conditional refetches
+	lastModified string // upstream Last-Modified, for conditional refetches
+}
+
+var (
+	liveMap  = make(map[string]*livePlaylist)
+	liveLock sync.Mutex
+)
+
+// servePlaylist returns the current playlist body for a registered media
+// playlist, transparently picking between the live snapshot and a one-shot
+// VOD rewrite.
+func servePlaylist(ctx context.Context, id, mediaURL string) string {
+	liveLock.Lock()
+	lp, ok := liveMap[id]
+	liveLock.Unlock()
+	if ok {
+		return lp.snapshot()
+	}
+
+	closed, body := rewriteMediaPlaylist(ctx, mediaURL)
+	if closed {
+		return body
+	}
+
+	return getOrStartLivePlaylist(id, mediaURL).snapshot()
+}
+
+// getOrStartLivePlaylist returns the live manager for id, starting its
+// background refresh goroutine on first use.
+func getOrStartLivePlaylist(id, mediaURL string) *livePlaylist {
+	liveLock.Lock()
+	defer liveLock.Unlock()
+
+	if lp, ok := liveMap[id]; ok {
+		return lp
+	}
+
+	lp := &livePlaylist{
+		mediaURL: mediaURL,
+		known:    make(map[string]bool),
+		evicted:  make(map[string]time.Time),
+	}
+	liveMap[id] = lp
+
+	lp.refresh()
+	go lp.run()
+
+	return lp
+}
+
+func (lp *livePlaylist) snapshot() string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.encoded
+}
+
+// run periodically re-fetches the upstream playlist, pacing itself on the
+// upstream TargetDuration once known.
+func (lp *livePlaylist) run() {
+	interval := 4 * time.Second
+	for {
+		time.Sleep(interval)
+		if d := lp.refresh(); d > 0 {
+			interval = d
+		}
+	}
+}
+
+// refresh re-fetches the upstream media playlist, slides any new segments
+// into the window (evicting the oldest as needed) and re-encodes the
+// snapshot. It returns the upstream TargetDuration so run can pace itself.
+func (lp *livePlaylist) refresh() time.Duration {
+	// Not tied to any single client request: this loop outlives whichever
+	// request first registered the playlist, so it always uses a background
+	// context rather than c.Request.Context().
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, lp.mediaURL, nil)
+	if err != nil {
+		fmt.Printf("live refresh %s: %s\n", lp.mediaURL, err)
+		return 0
+	}
+	applyOriginHeaders(req)
+
+	lp.mu.Lock()
+	if lp.etag != "" {
+		req.Header.Set("If-None-Match", lp.etag)
+	}
+	if lp.lastModified != "" {
+		req.Header.Set("If-Modified-Since", lp.lastModified)
+	}
+	previousInterval := targetDurationInterval(lp.pl)
+	lp.mu.Unlock()
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		fmt.Printf("live refresh %s: %s\n", lp.mediaURL, err)
+		return 0
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return previousInterval
+	}
+
+	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(res.Body), true)
+	if err != nil {
+		fmt.Printf("live refresh %s: %s\n", lp.mediaURL, err)
+		return 0
+	}
+	if listType != m3u8.MEDIA {
+		fmt.Println("live refresh: expected media playlist, got something else")
+		return 0
+	}
+	mediaPl := p.(*m3u8.MediaPlaylist)
+
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if etag := res.Header.Get("ETag"); etag != "" {
+		lp.etag = etag
+	}
+	if lastModified := res.Header.Get("Last-Modified"); lastModified != "" {
+		lp.lastModified = lastModified
+	}
+
+	if lp.pl == nil {
+		lp.pl, _ = m3u8.NewMediaPlaylist(liveWindowSize, liveWindowSize)
+		lp.pl.SeqNo = mediaPl.SeqNo
+	}
+	lp.pl.TargetDuration = mediaPl.TargetDuration
+	lp.pl.DiscontinuitySeq = mediaPl.DiscontinuitySeq
+	lp.pl.Closed = mediaPl.Closed
+
+	var newIDs []string
+	for _, segment := range mediaPl.Segments {
+		if segment == nil {
+			continue
+		}
+
+		fullURL := resolveRelative(lp.mediaURL, segment.URI)
+		ref := segmentRef{URL: fullURL, Offset: segment.Offset, Limit: segment.Limit}
+		id := segmentRouteID(ref.URL, ref.Offset, ref.Limit)
+		// Segments that already slid out stay in lp.evicted until gcEvicted
+		// drops them, so the upstream still listing them doesn't re-add them.
+		if _, slidOut := lp.evicted[id]; lp.known[id] || slidOut {
+			continue
+		}
+
+		mapLock.Lock()
+		segmentMap[id] = ref
+		mapLock.Unlock()
+		registerSegmentMeta(parentCacheID(ref.URL), ref.URL)
+
+		if len(lp.order) >= liveWindowSize {
+			oldestID := lp.order[0]
+			lp.order = lp.order[1:]
+			delete(lp.known, oldestID)
+			lp.evicted[oldestID] = time.Now()
+			if err := lp.pl.Remove(); err != nil {
+				fmt.Printf("live refresh: evicting oldest segment: %s\n", err)
+			}
+		}
+
+		newSeg := *segment
+		newSeg.URI = "/segment/" + id
+		rewriteSegmentKeyAndMap(segment, &newSeg, lp.mediaURL, id)
+		if err := lp.pl.AppendSegment(&newSeg); err != nil {
+			fmt.Printf("live refresh: appending segment: %s\n", err)
+			continue
+		}
+
+		lp.known[id] = true
+		lp.order = append(lp.order, id)
+		newIDs = append(newIDs, id)
+	}
+
+	enqueuePrefetch(newIDs)
+	persistCacheIndex()
+
+	var buf bytes.Buffer
+	lp.pl.Encode().WriteTo(&buf)
+	lp.encoded = buf.String()
+
+	lp.gcEvicted()
+
+	return targetDurationInterval(lp.pl)
+}
+
+// targetDurationInterval converts a playlist's TargetDuration into a refresh
+// interval, for pacing the background refresh loop. Callers must hold lp.mu.
+func targetDurationInterval(pl *m3u8.MediaPlaylist) time.Duration {
+	if pl == nil || pl.TargetDuration <= 0 {
+		return 0
+	}
+	return time.Duration(pl.TargetDuration * float64(time.Second))
+}
+
+// gcEvicted removes the cache file and segmentMap entry for any segment that
+// slid out of the window more than liveSegmentTTL ago. Callers must hold
+// lp.mu.
+func (lp *livePlaylist) gcEvicted() {
+	now := time.Now()
+	for id, evictedAt := range lp.evicted {
+		if now.Sub(evictedAt) < liveSegmentTTL {
+			continue
+		}
+		delete(lp.evicted, id)
+
+		mapLock.Lock()
+		ref, ok := segmentMap[id]
+		delete(segmentMap, id)
+		mapLock.Unlock()
+		if !ok {
+			continue
+		}
+
+		// A byte-range parent file can still be referenced by another
+		// segment id (an overlapping range, or the same whole-file segment
+		// reused elsewhere); only delete it once nothing points at it.
+		parentID := parentCacheID(ref.URL)
+		if parentStillReferenced(parentID) {
+			continue
+		}
+
+		segmentMetaLock.Lock()
+		delete(segmentMetaMap, parentID)
+		segmentMetaLock.Unlock()
+
+		if err := os.Remove(filepath.Join(cacheDir, parentID)); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("live gc: removing cached segment %s: %s\n", id, err)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
@@ -12,6 +13,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,33 +22,54 @@ import (
 	"github.com/grafov/m3u8"
 )
 
+// playlistEntry records how to re-derive a registered /:id/proxy.m3u8 route.
+// MediaURL is set when a specific variant was already selected (leading mode)
+// so the proxy route can skip re-selecting a variant from the master; when
+// it's empty the proxy route falls back to the legacy naive first-variant pick.
+type playlistEntry struct {
+	MasterURL string `json:"master_url"`
+	MediaURL  string `json:"media_url,omitempty"`
+}
+
 var (
-	playlistMap = make(map[string]string) // id -> remote URL
-	segmentMap  = make(map[string]string) // id -> remote URL
+	playlistMap = make(map[string]playlistEntry) // id -> playlist entry
+	segmentMap  = make(map[string]segmentRef)     // id -> upstream URL + byte range
 	mapLock     = sync.RWMutex{}
 	cacheDir    = "./cache"
 	maxRetries  = 30
 	retryDelay  = 500 * time.Millisecond
 )
 
+// variantFilter carries the query-string variant-selection options accepted
+// by /master.m3u8.
+type variantFilter struct {
+	mode         string // all | leading | passthrough
+	maxBandwidth uint32
+	minBandwidth uint32
+	resolution   string
+	codecs       []string
+}
+
 func main() {
 	if err := os.MkdirAll(cacheDir, 0755); err != nil {
 		panic(err)
 	}
+	loadCacheIndex()
 
 	r := gin.Default()
 
 	r.GET("/master.m3u8", func(c *gin.Context) {
-		url := c.Query("url")
+		streamURL := c.Query("url")
+		filter := parseVariantFilter(c)
 
-		c.String(200, generatePlaylistWithLocalURIs(url, true))
+		c.String(200, generateMasterPlaylist(c.Request.Context(), streamURL, filter))
 	})
 
 	r.GET("/:id/proxy.m3u8", func(c *gin.Context) {
 		id := c.Param("id")
 
 		mapLock.RLock()
-		url, ok := playlistMap[id]
+		entry, ok := playlistMap[id]
 		mapLock.RUnlock()
 
 		if !ok {
@@ -53,8 +77,27 @@ func main() {
 			return
 		}
 
-		// This should serve the playlist rewritten with /segment/:id URIs
-		c.String(200, generatePlaylistWithLocalURIs(url, false))
+		ctx := c.Request.Context()
+
+		mediaURL := entry.MediaURL
+		if mediaURL == "" {
+			masterpl, err := fetchMasterPlaylist(ctx, entry.MasterURL)
+			if err != nil {
+				fmt.Println(err)
+				c.String(500, "failed to fetch master playlist: %s", err)
+				return
+			}
+			if len(masterpl.Variants) == 0 {
+				c.String(500, "no variants found")
+				return
+			}
+			// Naively pick the first variant
+			mediaURL = resolveRelative(entry.MasterURL, masterpl.Variants[0].URI)
+		}
+
+		// Serves the live snapshot if this playlist is live, otherwise a
+		// one-shot rewrite with /segment/:id URIs.
+		c.String(200, servePlaylist(ctx, id, mediaURL))
 	})
 
 	// Serve or fetch segments
@@ -62,7 +105,7 @@ func main() {
 		id := c.Param("id")
 
 		mapLock.RLock()
-		url, ok := segmentMap[id]
+		ref, ok := segmentMap[id]
 		mapLock.RUnlock()
 
 		if !ok {
@@ -70,28 +113,80 @@ func main() {
 			return
 		}
 
-		// Download if missing
-		filename := filepath.Join(cacheDir, id)
-		if _, err := os.Stat(filename); os.IsNotExist(err) {
-			if err := downloadWithRetries(url, filename); err != nil {
-				c.String(500, "failed to fetch segment: %s", err)
-				return
-			}
+		// Several segment ids (different EXT-X-BYTERANGE slices) can share one
+		// parent file, so downloading/dedup keys on the parent id, not the
+		// route id, meaning the file is only ever fetched once.
+		parentID := parentCacheID(ref.URL)
+		if err := ensureSegmentDownloaded(c.Request.Context(), parentID, ref.URL); err != nil {
+			c.String(500, "failed to fetch segment: %s", err)
+			return
+		}
+		touchSegmentAccess(parentID)
+
+		// serveSegment honors any inbound Range header itself (206 partial
+		// responses for seek/scrub), slicing to ref's EXT-X-BYTERANGE window
+		// when set.
+		serveSegment(c, ref)
+	})
+
+	r.GET("/key/:id", func(c *gin.Context) {
+		id := c.Param("id")
+
+		mapLock.RLock()
+		url, ok := keyMap[id]
+		mapLock.RUnlock()
+
+		if !ok {
+			c.String(404, "key not found")
+			return
+		}
+
+		keyID := "key_" + id
+		if err := ensureSegmentDownloaded(c.Request.Context(), keyID, url); err != nil {
+			c.String(500, "failed to fetch key: %s", err)
+			return
+		}
+
+		c.File(filepath.Join(cacheDir, keyID))
+	})
+
+	r.GET("/init/:id", func(c *gin.Context) {
+		id := c.Param("id")
+
+		mapLock.RLock()
+		url, ok := initMap[id]
+		mapLock.RUnlock()
+
+		if !ok {
+			c.String(404, "init segment not found")
+			return
+		}
+
+		initID := "init_" + id
+		if err := ensureSegmentDownloaded(c.Request.Context(), initID, url); err != nil {
+			c.String(500, "failed to fetch init segment: %s", err)
+			return
 		}
 
-		c.File(filename)
+		c.File(filepath.Join(cacheDir, initID))
 	})
 
 	r.Run(":3144")
 }
 
-func downloadWithRetries(url, filename string) error {
+// downloadWithRetries downloads url to filename, retrying on failure, and
+// returns the upstream Content-Type/ETag for the caller to persist alongside
+// the cached file.
+func downloadWithRetries(ctx context.Context, url, filename string) (contentType, etag string, err error) {
 	var lastErr error
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		err := downloadToFile(url, filename)
+		contentType, etag, err = downloadToFile(ctx, url, filename)
 		if err == nil {
-			return nil
+			return contentType, etag, nil
+		}
+		if ctx.Err() != nil {
+			return "", "", ctx.Err()
 		}
 
 		lastErr = err
@@ -100,142 +195,311 @@ func downloadWithRetries(url, filename string) error {
 		time.Sleep(retryDelay)
 	}
 
-	return fmt.Errorf("all %d retries failed for %s: %w", maxRetries, url, lastErr)
+	return "", "", fmt.Errorf("all %d retries failed for %s: %w", maxRetries, url, lastErr)
 }
 
 // Downloads the given URL to a local file safely (via temp file)
-func downloadToFile(url, filename string) error {
-	resp, err := http.Get(url)
+func downloadToFile(ctx context.Context, url, filename string) (contentType, etag string, err error) {
+	resp, err := httpGet(ctx, url)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(resp.Status)
+		return "", "", errors.New(resp.Status)
 	}
 
 	tmpfile := filename + ".tmp"
 	f, err := os.Create(tmpfile)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	defer f.Close()
 
 	if _, err := io.Copy(f, resp.Body); err != nil {
-		return err
+		return "", "", err
+	}
+
+	if err := os.Rename(tmpfile, filename); err != nil {
+		return "", "", err
 	}
 
-	return os.Rename(tmpfile, filename)
+	return resp.Header.Get("Content-Type"), resp.Header.Get("ETag"), nil
 }
 
-func generatePlaylistWithLocalURIs(streamURL string, generate_master bool) string {
-	res, err := http.Get(streamURL)
-	if err != nil {
-		fmt.Printf("error making http request: %s\n", err)
-		return ""
+// parseVariantFilter reads the variant-selection query parameters accepted by
+// /master.m3u8: max_bandwidth, min_bandwidth, resolution, codecs and mode.
+func parseVariantFilter(c *gin.Context) variantFilter {
+	f := variantFilter{mode: c.DefaultQuery("mode", "all")}
+
+	if v := c.Query("max_bandwidth"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+			f.maxBandwidth = uint32(n)
+		}
 	}
-	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(res.Body), true)
-	if err != nil {
-		fmt.Println(err)
-		return ""
+	if v := c.Query("min_bandwidth"); v != "" {
+		if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+			f.minBandwidth = uint32(n)
+		}
+	}
+	f.resolution = c.Query("resolution")
+	if v := c.Query("codecs"); v != "" {
+		f.codecs = strings.Split(v, ",")
 	}
 
-	switch listType {
-	case m3u8.MASTER:
-		masterpl := p.(*m3u8.MasterPlaylist)
-		fmt.Printf("Master playlist has %d variants\n", len(masterpl.Variants))
+	return f
+}
 
-		if generate_master {
-			h := sha256.New()
-			h.Write([]byte(streamURL))
-			id := base64.URLEncoding.EncodeToString(h.Sum(nil))
+// generateMasterPlaylist dispatches a /master.m3u8 request according to
+// filter.mode:
+//   - "all" (default) keeps the legacy behavior of rewriting every variant.
+//   - "leading" rewrites only the variant selected by filter into a
+//     single-variant master.
+//   - "passthrough" skips the master entirely and returns the rewritten
+//     media playlist of the selected variant.
+func generateMasterPlaylist(ctx context.Context, streamURL string, filter variantFilter) string {
+	switch filter.mode {
+	case "leading", "passthrough":
+		masterpl, err := fetchMasterPlaylist(ctx, streamURL)
+		if err != nil {
+			fmt.Println(err)
+			return ""
+		}
 
-			mapLock.Lock()
-			playlistMap[id] = streamURL
-			mapLock.Unlock()
+		variant := selectVariant(masterpl.Variants, filter)
+		if variant == nil {
+			fmt.Println("No variants found in master playlist.")
+			return ""
+		}
 
-			cloned_master := m3u8.NewMasterPlaylist()
-			for _, variant := range masterpl.Variants {
-				variant.URI = "/" + id + "/proxy.m3u8"
-				cloned_master.Variants = append(cloned_master.Variants, variant)
-			}
+		mediaFullURL := resolveRelative(streamURL, variant.URI)
+		id := hashID(mediaFullURL)
 
-			var buf bytes.Buffer
-			cloned_master.Encode().WriteTo(&buf)
+		mapLock.Lock()
+		playlistMap[id] = playlistEntry{MasterURL: streamURL, MediaURL: mediaFullURL}
+		mapLock.Unlock()
+		persistCacheIndex()
 
-			return buf.String()
+		if filter.mode == "passthrough" {
+			// Goes through servePlaylist like the leading path's
+			// /:id/proxy.m3u8 route does, so a live upstream gets served from
+			// the background-refreshed snapshot instead of doing a
+			// synchronous upstream fetch on every single client poll.
+			return servePlaylist(ctx, id, mediaFullURL)
 		}
 
-		if len(masterpl.Variants) == 0 {
-			fmt.Println("No variants found.")
-			return ""
-		}
+		cloned_master := m3u8.NewMasterPlaylist()
+		leadingVariant := *variant
+		leadingVariant.URI = "/" + id + "/proxy.m3u8"
+		cloned_master.Variants = append(cloned_master.Variants, &leadingVariant)
 
-		// Naively pick the first variant
-		mediaURL := masterpl.Variants[0].URI
-		fmt.Println("Selected media playlist:", mediaURL)
+		var buf bytes.Buffer
+		cloned_master.Encode().WriteTo(&buf)
 
-		// Optional: resolve relative URLs
-		mediaFullURL := resolveRelative(streamURL, mediaURL)
-		fmt.Println(mediaFullURL)
+		return buf.String()
+	default:
+		return buildAllVariantsMaster(ctx, streamURL)
+	}
+}
 
-		// Now fetch the media playlist
-		mediaRes, err := http.Get(mediaFullURL)
-		if err != nil {
-			fmt.Printf("error fetching media playlist: %s\n", err)
-			return ""
+// selectVariant picks the best variant matching filter, similar to the
+// mediamtx pickLeadingPlaylist approach: filter out unsupported/undesired
+// variants, then pick the highest-bandwidth surviving one by default, or the
+// lowest variant that still clears min_bandwidth when that's set. When no
+// variant passes the filters, it picks from all variants instead, so it only
+// returns nil when variants holds no variant at all.
+func selectVariant(variants []*m3u8.Variant, filter variantFilter) *m3u8.Variant {
+	candidates := make([]*m3u8.Variant, 0, len(variants))
+	for _, v := range variants {
+		if v == nil {
+			continue
+		}
+		if filter.resolution != "" && v.Resolution != filter.resolution {
+			continue
+		}
+		if len(filter.codecs) > 0 && !codecsSatisfied(v.Codecs, filter.codecs) {
+			continue
 		}
-		defer mediaRes.Body.Close()
+		if filter.maxBandwidth > 0 && v.Bandwidth > filter.maxBandwidth {
+			continue
+		}
+		candidates = append(candidates, v)
+	}
 
-		mp, listType, err := m3u8.DecodeFrom(bufio.NewReader(mediaRes.Body), true)
-		if err != nil {
-			fmt.Printf("error decoding media playlist: %s\n", err)
-			return ""
+	if len(candidates) == 0 {
+		candidates = variants
+	}
+
+	if filter.minBandwidth > 0 {
+		// min_bandwidth was explicitly requested: prefer the lowest variant
+		// that still clears the floor.
+		var lowestAboveFloor *m3u8.Variant
+		for _, v := range candidates {
+			if v == nil || v.Bandwidth < filter.minBandwidth {
+				continue
+			}
+			if lowestAboveFloor == nil || v.Bandwidth < lowestAboveFloor.Bandwidth {
+				lowestAboveFloor = v
+			}
+		}
+		if lowestAboveFloor != nil {
+			return lowestAboveFloor
 		}
+		// Nothing cleared min_bandwidth; fall through to the highest-bandwidth
+		// candidate rather than returning nothing.
+	}
 
-		if listType != m3u8.MEDIA {
-			fmt.Println("Expected media playlist, got something else")
-			return ""
+	var best *m3u8.Variant
+	for _, v := range candidates {
+		if v != nil && (best == nil || v.Bandwidth > best.Bandwidth) {
+			best = v
 		}
+	}
+	return best
+}
 
-		mediaPl := mp.(*m3u8.MediaPlaylist)
-		fmt.Printf("Media playlist has %d segments\n", mediaPl.Count())
+// codecsSatisfied reports whether every codec token in wanted appears in the
+// variant's CODECS attribute.
+func codecsSatisfied(variantCodecs string, wanted []string) bool {
+	for _, w := range wanted {
+		if !strings.Contains(variantCodecs, strings.TrimSpace(w)) {
+			return false
+		}
+	}
+	return true
+}
 
-		n := uint(len(mediaPl.Segments))
-		cloned, _ := m3u8.NewMediaPlaylist(n, n)
-		cloned.Closed = true
+// hashID derives the stable, URL-safe id used to key playlistMap/segmentMap
+// entries from an absolute upstream URL.
+func hashID(s string) string {
+	h := sha256.New()
+	h.Write([]byte(s))
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
 
-		for _, segment := range mediaPl.Segments {
-			if segment == nil {
-				continue
-			}
+// fetchMasterPlaylist downloads and decodes streamURL, returning an error if
+// it isn't a master playlist.
+func fetchMasterPlaylist(ctx context.Context, streamURL string) (*m3u8.MasterPlaylist, error) {
+	res, err := httpGet(ctx, streamURL)
+	if err != nil {
+		return nil, fmt.Errorf("error making http request: %w", err)
+	}
+	defer res.Body.Close()
 
-			fullUrl := resolveRelative(mediaFullURL, segment.URI)
-			h := sha256.New()
-			h.Write([]byte(fullUrl))
-			id := base64.URLEncoding.EncodeToString(h.Sum(nil))
-			fmt.Printf("Segment URI as %s: %s\n", id, fullUrl)
+	p, listType, err := m3u8.DecodeFrom(bufio.NewReader(res.Body), true)
+	if err != nil {
+		return nil, err
+	}
+	if listType != m3u8.MASTER {
+		return nil, errors.New("expected master playlist, got something else")
+	}
+
+	return p.(*m3u8.MasterPlaylist), nil
+}
+
+// rewriteMediaPlaylist fetches the media playlist at mediaFullURL, clones it
+// with every segment URI replaced by a local /segment/:id route, and returns
+// whether the upstream was closed (VOD, has EXT-X-ENDLIST) along with the
+// encoded playlist. It performs a single one-shot fetch; live playlists are
+// served from a livePlaylist snapshot instead, see live.go.
+func rewriteMediaPlaylist(ctx context.Context, mediaFullURL string) (bool, string) {
+	mediaRes, err := httpGet(ctx, mediaFullURL)
+	if err != nil {
+		fmt.Printf("error fetching media playlist: %s\n", err)
+		return true, ""
+	}
+	defer mediaRes.Body.Close()
+
+	mp, listType, err := m3u8.DecodeFrom(bufio.NewReader(mediaRes.Body), true)
+	if err != nil {
+		fmt.Printf("error decoding media playlist: %s\n", err)
+		return true, ""
+	}
+
+	if listType != m3u8.MEDIA {
+		fmt.Println("Expected media playlist, got something else")
+		return true, ""
+	}
 
-			mapLock.Lock()
-			segmentMap[id] = fullUrl
-			mapLock.Unlock()
+	mediaPl := mp.(*m3u8.MediaPlaylist)
+	fmt.Printf("Media playlist has %d segments\n", mediaPl.Count())
 
-			newSeg := *segment
-			newSeg.URI = "/segment/" + id
+	n := uint(len(mediaPl.Segments))
+	cloned, _ := m3u8.NewMediaPlaylist(n, n)
+	cloned.Closed = mediaPl.Closed
+	cloned.SeqNo = mediaPl.SeqNo
+	cloned.TargetDuration = mediaPl.TargetDuration
+	cloned.DiscontinuitySeq = mediaPl.DiscontinuitySeq
 
-			cloned.AppendSegment(&newSeg)
+	ids := make([]string, 0, len(mediaPl.Segments))
+	for _, segment := range mediaPl.Segments {
+		if segment == nil {
+			continue
 		}
 
-		fmt.Printf("Segment list length: %d, mediaPl.Count(): %d\n", len(mediaPl.Segments), mediaPl.Count())
+		fullUrl := resolveRelative(mediaFullURL, segment.URI)
+		ref := segmentRef{URL: fullUrl, Offset: segment.Offset, Limit: segment.Limit}
+		id := segmentRouteID(ref.URL, ref.Offset, ref.Limit)
+		fmt.Printf("Segment URI as %s: %s\n", id, fullUrl)
 
-		var buf bytes.Buffer
-		cloned.Encode().WriteTo(&buf)
+		mapLock.Lock()
+		segmentMap[id] = ref
+		mapLock.Unlock()
+		registerSegmentMeta(parentCacheID(ref.URL), ref.URL)
 
-		return buf.String()
+		// newSeg is a value copy of segment, so its Limit/Offset (and thus
+		// the EXT-X-BYTERANGE line on encode) are preserved automatically.
+		newSeg := *segment
+		newSeg.URI = "/segment/" + id
+		rewriteSegmentKeyAndMap(segment, &newSeg, mediaFullURL, id)
+
+		cloned.AppendSegment(&newSeg)
+		ids = append(ids, id)
 	}
 
-	return ""
+	fmt.Printf("Segment list length: %d, mediaPl.Count(): %d\n", len(mediaPl.Segments), mediaPl.Count())
+
+	if len(ids) > prefetchReadahead {
+		ids = ids[:prefetchReadahead]
+	}
+	enqueuePrefetch(ids)
+	persistCacheIndex()
+
+	var buf bytes.Buffer
+	cloned.Encode().WriteTo(&buf)
+
+	return mediaPl.Closed, buf.String()
+}
+
+// buildAllVariantsMaster registers streamURL under a new id and returns a
+// master playlist with every variant rewritten to "/"+id+"/proxy.m3u8" (the
+// default /master.m3u8 "all" mode).
+func buildAllVariantsMaster(ctx context.Context, streamURL string) string {
+	masterpl, err := fetchMasterPlaylist(ctx, streamURL)
+	if err != nil {
+		fmt.Println(err)
+		return ""
+	}
+	fmt.Printf("Master playlist has %d variants\n", len(masterpl.Variants))
+
+	id := hashID(streamURL)
+
+	mapLock.Lock()
+	playlistMap[id] = playlistEntry{MasterURL: streamURL}
+	mapLock.Unlock()
+	persistCacheIndex()
+
+	cloned_master := m3u8.NewMasterPlaylist()
+	for _, variant := range masterpl.Variants {
+		variant.URI = "/" + id + "/proxy.m3u8"
+		cloned_master.Variants = append(cloned_master.Variants, variant)
+	}
+
+	var buf bytes.Buffer
+	cloned_master.Encode().WriteTo(&buf)
+
+	return buf.String()
 }
 
 func resolveRelative(base, rel string) string {
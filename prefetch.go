@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// prefetchConcurrency is the number of background prefetch workers, which
+// bounds how many prefetch downloads run at once. On-demand /segment/:id
+// downloads are started directly by ensureSegmentDownloaded and are not
+// counted against it.
+const prefetchConcurrency = 4
+
+// prefetchReadahead is how many of the first segments of a one-shot (VOD)
+// playlist rewrite are queued for background download. Live refreshes queue
+// every newly seen segment instead.
+const prefetchReadahead = 3
+
+// prefetchQueueSize bounds how many pending prefetch jobs are buffered
+// before new ones are dropped; a full queue means the workers are already
+// behind, so there's no point blocking the caller to enqueue more.
+const prefetchQueueSize = 256
+
+type prefetchJob struct {
+	id  string
+	url string
+}
+
+var prefetchQueue = make(chan prefetchJob, prefetchQueueSize)
+
+var (
+	inflightLock sync.Mutex
+	inflight     = make(map[string]chan struct{}) // segment id -> closed once its download finishes
+)
+
+func init() {
+	for i := 0; i < prefetchConcurrency; i++ {
+		go prefetchWorker()
+	}
+}
+
+func prefetchWorker() {
+	for job := range prefetchQueue {
+		// Prefetching isn't tied to any single client request, so it always
+		// runs to completion rather than being cancelable mid-download.
+		if err := ensureSegmentDownloaded(context.Background(), job.id, job.url); err != nil {
+			fmt.Printf("prefetch: segment %s: %s\n", job.id, err)
+		}
+	}
+}
+
+// enqueuePrefetch schedules the given segment ids' parent files for
+// background download, skipping any that are already cached. Several ids
+// (different EXT-X-BYTERANGE slices) can share one parent file, so the job
+// is keyed and deduped on the parent id.
+func enqueuePrefetch(ids []string) {
+	for _, id := range ids {
+		mapLock.RLock()
+		ref, ok := segmentMap[id]
+		mapLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		parentID := parentCacheID(ref.URL)
+		if _, err := os.Stat(filepath.Join(cacheDir, parentID)); err == nil {
+			continue
+		}
+
+		select {
+		case prefetchQueue <- prefetchJob{id: parentID, url: ref.URL}:
+		default:
+			fmt.Printf("prefetch queue full, dropping segment %s\n", parentID)
+		}
+	}
+}
+
+// ensureSegmentDownloaded downloads a segment to cacheDir if it isn't
+// already there, de-duplicating concurrent callers (prefetch workers and
+// /segment/:id requests) so the same segment is never fetched twice at once.
+// The download itself always runs to completion on its own, detached from
+// any single caller's ctx, since other callers (or the next request for the
+// same segment) may still be waiting on it; ctx only governs how long this
+// particular call is willing to wait.
+func ensureSegmentDownloaded(ctx context.Context, id, url string) error {
+	filename := filepath.Join(cacheDir, id)
+
+	inflightLock.Lock()
+	done, ok := inflight[id]
+	if !ok {
+		done = make(chan struct{})
+		inflight[id] = done
+		go downloadSegment(id, url, filename, done)
+	}
+	inflightLock.Unlock()
+
+	select {
+	case <-done:
+		_, err := os.Stat(filename)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadSegment downloads, decrypts and records filename for id, then
+// closes done. It always uses context.Background() rather than any caller's
+// ctx: it's kicked off by whichever caller happened to be first, but every
+// other concurrent (and future) caller for the same id waits on the same
+// download, so one caller disconnecting must not abort it for the rest.
+func downloadSegment(id, url, filename string, done chan struct{}) {
+	defer func() {
+		inflightLock.Lock()
+		delete(inflight, id)
+		inflightLock.Unlock()
+		close(done)
+	}()
+
+	if _, err := os.Stat(filename); err == nil {
+		return
+	}
+
+	ctx := context.Background()
+	contentType, etag, err := downloadWithRetries(ctx, url, filename)
+	if err != nil {
+		fmt.Printf("download segment %s: %s\n", id, err)
+		return
+	}
+	if err := decryptSegmentFile(ctx, id, filename); err != nil {
+		fmt.Printf("decrypt segment %s: %s\n", id, err)
+		return
+	}
+	recordSegmentDownloaded(id, filename, contentType, etag)
+}